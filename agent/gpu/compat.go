@@ -0,0 +1,218 @@
+// +build linux
+
+// Copyright 2021 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package gpu
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DriverCompatibilityErrorReason is the structured stopped-task reason the
+// task engine should surface when a task can't run on the driver installed
+// on this instance, instead of letting the container fail to create.
+const DriverCompatibilityErrorReason = "GPU_DRIVER_INCOMPATIBLE"
+
+// DriverCompatibilityError is returned by CheckDriverCompatibility when a
+// task's GPU/CUDA version requirements can't be met by the driver installed
+// on this instance.
+type DriverCompatibilityError struct {
+	msg string
+}
+
+func (e *DriverCompatibilityError) Error() string {
+	return e.msg
+}
+
+// driverCompatOverridePath is where operators may drop a custom
+// compatibility matrix, overriding builtinDriverCompatMatrix wholesale.
+const driverCompatOverridePath = "/etc/ecs/gpu-compat.json"
+
+// driverCompatEntry maps a GPU product family to the driver major versions
+// known to support it, most-preferred first, mirroring the fallbackMap idea
+// from cos_gpu_installer.
+type driverCompatEntry struct {
+	// ProductMatches are case-insensitive substrings of the NVML product
+	// name (e.g. "A100", "T4") that identify a GPU as belonging to this
+	// family.
+	ProductMatches []string `json:"ProductMatches"`
+	// SupportedMajors are the driver major versions (e.g. "525", "470")
+	// known to support this family, most-preferred first.
+	SupportedMajors []string `json:"SupportedMajors"`
+}
+
+// builtinDriverCompatMatrix covers the common Turing/Ampere/Hopper
+// generations ECS GPU instances ship with.
+var builtinDriverCompatMatrix = []driverCompatEntry{
+	{
+		// Turing, e.g. g4dn instances.
+		ProductMatches:  []string{"T4", "RTX 20", "Quadro RTX"},
+		SupportedMajors: []string{"470"},
+	},
+	{
+		// Ampere, e.g. p4d/g5 instances.
+		ProductMatches:  []string{"A100", "A10G", "A10", "A30", "A40"},
+		SupportedMajors: []string{"525", "470"},
+	},
+	{
+		// Hopper, e.g. p5 instances.
+		ProductMatches:  []string{"H100", "H200"},
+		SupportedMajors: []string{"535", "525"},
+	},
+}
+
+// loadDriverCompatMatrix returns the operator override at
+// driverCompatOverridePath if one is present and valid, falling back to
+// builtinDriverCompatMatrix otherwise.
+func loadDriverCompatMatrix() []driverCompatEntry {
+	data, err := ioutil.ReadFile(driverCompatOverridePath)
+	if err != nil {
+		return builtinDriverCompatMatrix
+	}
+	var override []driverCompatEntry
+	if err := json.Unmarshal(data, &override); err != nil {
+		return builtinDriverCompatMatrix
+	}
+	return override
+}
+
+// matrixEntryForProduct finds the compatibility entry for a GPU product
+// name, returning ok=false if the product isn't in the matrix, in which
+// case no version constraint is enforced for it.
+func matrixEntryForProduct(matrix []driverCompatEntry, productName string) (driverCompatEntry, bool) {
+	lowerProduct := strings.ToLower(productName)
+	for _, entry := range matrix {
+		for _, match := range entry.ProductMatches {
+			if strings.Contains(lowerProduct, strings.ToLower(match)) {
+				return entry, true
+			}
+		}
+	}
+	return driverCompatEntry{}, false
+}
+
+// driverMajor returns the major version component of a driver version
+// string, e.g. "525.105.17" -> "525".
+func driverMajor(version string) string {
+	if idx := strings.Index(version, "."); idx != -1 {
+		return version[:idx]
+	}
+	return version
+}
+
+// versionAtLeast reports whether version satisfies the dotted-numeric
+// minimum, e.g. versionAtLeast("12.2", "12.0") == true. Non-numeric or
+// missing components of either string are treated as 0, so "12" satisfies
+// "12.0" but not "12.1", and a non-numeric version fails any non-zero minimum.
+func versionAtLeast(version, minimum string) bool {
+	if minimum == "" {
+		return true
+	}
+	versionParts := strings.Split(version, ".")
+	minParts := strings.Split(minimum, ".")
+	for i := 0; i < len(minParts); i++ {
+		var v, m int
+		if i < len(versionParts) {
+			v, _ = strconv.Atoi(versionParts[i])
+		}
+		m, _ = strconv.Atoi(minParts[i])
+		if v != m {
+			return v > m
+		}
+	}
+	return true
+}
+
+// CheckDriverCompatibility validates that the GPUs a task has been assigned
+// (gpuIDs, whole-GPU or MIG UUIDs) satisfy the task's declared minimum
+// driver version and/or CUDA runtime requirement. It is meant to be called
+// by the task engine at placement time so an incompatible task can be
+// stopped with DriverCompatibilityErrorReason instead of failing opaquely
+// when the nvidia container runtime refuses to start the container.
+func (n *NvidiaGPUManager) CheckDriverCompatibility(minDriver, minCUDA string, gpuIDs []string) error {
+	driverVersion := n.GetDriverVersion()
+	cudaVersion := n.GetCUDAVersion()
+
+	// An empty discovered version means we were never able to determine it
+	// (e.g. this manager loaded from the legacy nvidia-gpu-info.json cache,
+	// which doesn't carry a CUDA version at all), not that it's "version
+	// 0". Skip the check rather than failing every task outright, the same
+	// way the per-GPU product-matrix check below skips devices it can't
+	// identify.
+	if minCUDA != "" && cudaVersion != "" && !versionAtLeast(cudaVersion, minCUDA) {
+		return &DriverCompatibilityError{msg: errors.Errorf(
+			"CUDA version %s does not satisfy task minimum %s", cudaVersion, minCUDA).Error()}
+	}
+	if minDriver != "" && driverVersion != "" && !versionAtLeast(driverVersion, minDriver) {
+		return &DriverCompatibilityError{msg: errors.Errorf(
+			"driver version %s does not satisfy task minimum %s", driverVersion, minDriver).Error()}
+	}
+
+	matrix := n.driverCompatMatrix
+	if matrix == nil {
+		// Manager wasn't built via NewNvidiaGPUManager (e.g. unmarshaled
+		// from the JSON cache, or constructed directly in tests); fall back
+		// to the builtin matrix rather than re-reading the override file
+		// here on every call.
+		matrix = builtinDriverCompatMatrix
+	}
+	devicesByUUID := make(map[string]GPUDevice, len(n.GetGPUDevices()))
+	for _, device := range n.GetGPUDevices() {
+		devicesByUUID[device.UUID] = device
+	}
+	parentByMIGUUID := make(map[string]string, len(n.GetMIGDevices()))
+	for _, migDevice := range n.GetMIGDevices() {
+		parentByMIGUUID[migDevice.UUID] = migDevice.ParentGPUUUID
+	}
+
+	currentMajor := driverMajor(driverVersion)
+	for _, gpuID := range gpuIDs {
+		device, ok := devicesByUUID[gpuID]
+		if !ok {
+			if parentUUID, isMIG := parentByMIGUUID[gpuID]; isMIG {
+				device, ok = devicesByUUID[parentUUID]
+			}
+		}
+		if !ok {
+			// Device info wasn't discovered via NVML (e.g. the manager
+			// loaded from the legacy JSON cache); nothing to check.
+			continue
+		}
+
+		entry, ok := matrixEntryForProduct(matrix, device.ProductName)
+		if !ok {
+			continue
+		}
+
+		supported := false
+		for _, major := range entry.SupportedMajors {
+			if major == currentMajor {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return &DriverCompatibilityError{msg: errors.Errorf(
+				"driver %s (major %s) is not in the supported major versions %v for GPU %q",
+				driverVersion, currentMajor, entry.SupportedMajors, device.ProductName).Error()}
+		}
+	}
+
+	return nil
+}
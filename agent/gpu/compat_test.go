@@ -0,0 +1,123 @@
+// +build linux
+
+// Copyright 2021 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package gpu
+
+import "testing"
+
+func TestDriverMajor(t *testing.T) {
+	tests := []struct{ version, want string }{
+		{"525.105.17", "525"},
+		{"470.0", "470"},
+		{"535", "535"},
+		{"", ""},
+	}
+	for _, tc := range tests {
+		if got := driverMajor(tc.version); got != tc.want {
+			t.Errorf("driverMajor(%q) = %q, want %q", tc.version, got, tc.want)
+		}
+	}
+}
+
+func TestVersionAtLeast(t *testing.T) {
+	tests := []struct {
+		version, minimum string
+		want             bool
+	}{
+		{"12.2", "12.0", true},
+		{"12.0", "12.2", false},
+		{"12.2", "12.2", true},
+		{"12", "12.0", true},
+		{"11.8", "12.0", false},
+		{"12.2", "", true},
+		{"", "12.0", false},
+		{"not-a-version", "12.0", false},
+	}
+	for _, tc := range tests {
+		if got := versionAtLeast(tc.version, tc.minimum); got != tc.want {
+			t.Errorf("versionAtLeast(%q, %q) = %v, want %v", tc.version, tc.minimum, got, tc.want)
+		}
+	}
+}
+
+func TestMatrixEntryForProduct(t *testing.T) {
+	matrix := []driverCompatEntry{
+		{ProductMatches: []string{"T4"}, SupportedMajors: []string{"470"}},
+		{ProductMatches: []string{"A100", "A10G"}, SupportedMajors: []string{"525", "470"}},
+	}
+
+	t.Run("matches case-insensitively", func(t *testing.T) {
+		entry, ok := matrixEntryForProduct(matrix, "NVIDIA A100-SXM4-40GB")
+		if !ok {
+			t.Fatal("expected a match for A100")
+		}
+		if entry.SupportedMajors[0] != "525" {
+			t.Errorf("got majors %v, want A100's entry", entry.SupportedMajors)
+		}
+	})
+
+	t.Run("no match for unknown product", func(t *testing.T) {
+		if _, ok := matrixEntryForProduct(matrix, "NVIDIA H100"); ok {
+			t.Error("expected no match for a product not in the matrix")
+		}
+	})
+}
+
+func TestCheckDriverCompatibilitySkipsUndiscoveredVersions(t *testing.T) {
+	// A manager that loaded from the legacy nvidia-gpu-info.json cache never
+	// populates CUDAVersion (that field didn't exist in ecs-init's pre-NVML
+	// payload), and DriverVersion could be similarly unknown. A minimum
+	// requirement must be skipped, not treated as failing against "".
+	n := &NvidiaGPUManager{}
+	if err := n.CheckDriverCompatibility("470.0", "11.0", nil); err != nil {
+		t.Errorf("expected no error when driver/CUDA versions are undiscovered, got %v", err)
+	}
+}
+
+func TestCheckDriverCompatibilityEnforcesKnownVersions(t *testing.T) {
+	n := &NvidiaGPUManager{}
+	n.SetDriverVersion("470.57.02")
+
+	if err := n.CheckDriverCompatibility("525.0", "", nil); err == nil {
+		t.Error("expected an error when the known driver version is below the task minimum")
+	}
+	if err := n.CheckDriverCompatibility("470.0", "", nil); err != nil {
+		t.Errorf("expected no error when the known driver version satisfies the task minimum, got %v", err)
+	}
+}
+
+func TestCheckDriverCompatibilitySkipsUnrecognizedProduct(t *testing.T) {
+	n := &NvidiaGPUManager{}
+	n.SetDriverVersion("999.0.0")
+	n.SetGPUDevices([]GPUDevice{{UUID: "GPU-1", ProductName: "Some Future GPU"}})
+
+	if err := n.CheckDriverCompatibility("", "", []string{"GPU-1"}); err != nil {
+		t.Errorf("expected no error for a product absent from the compat matrix, got %v", err)
+	}
+}
+
+func TestCheckDriverCompatibilityRejectsUnsupportedMajor(t *testing.T) {
+	n := &NvidiaGPUManager{}
+	n.SetDriverVersion("999.0.0")
+	n.SetGPUDevices([]GPUDevice{{UUID: "GPU-1", ProductName: "NVIDIA A100"}})
+
+	err := n.CheckDriverCompatibility("", "", []string{"GPU-1"})
+	if err == nil {
+		t.Fatal("expected an error for a driver major not in A100's supported list")
+	}
+	if _, ok := err.(*DriverCompatibilityError); !ok {
+		t.Errorf("expected a *DriverCompatibilityError, got %T", err)
+	}
+}
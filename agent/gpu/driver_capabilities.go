@@ -0,0 +1,151 @@
+// +build linux
+
+// Copyright 2021 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package gpu
+
+import (
+	"os"
+	"strings"
+
+	"github.com/cihub/seelog"
+	"github.com/pkg/errors"
+)
+
+// DriverCapability is a single capability that can be requested of the
+// nvidia-container-runtime via NVIDIA_DRIVER_CAPABILITIES.
+type DriverCapability string
+
+const (
+	DriverCapabilityCompute  DriverCapability = "compute"
+	DriverCapabilityUtility  DriverCapability = "utility"
+	DriverCapabilityGraphics DriverCapability = "graphics"
+	DriverCapabilityVideo    DriverCapability = "video"
+	DriverCapabilityDisplay  DriverCapability = "display"
+	DriverCapabilityCompat32 DriverCapability = "compat32"
+
+	// NvidiaDriverCapabilitiesEnvVar is the environment variable the nvidia
+	// container runtime reads to decide which driver components to mount
+	// into the container.
+	NvidiaDriverCapabilitiesEnvVar = "NVIDIA_DRIVER_CAPABILITIES"
+	// NvidiaVisibleDevicesEnvVar is the environment variable the nvidia
+	// container runtime reads to decide which GPUs to expose.
+	NvidiaVisibleDevicesEnvVar = "NVIDIA_VISIBLE_DEVICES"
+
+	// AllowedDriverCapabilitiesEnvVar is the agent config environment
+	// variable operators use to restrict which NVIDIA driver capabilities
+	// tasks on this instance may request, as a comma-separated list.
+	AllowedDriverCapabilitiesEnvVar = "ECS_NVIDIA_ALLOWED_DRIVER_CAPABILITIES"
+)
+
+// allDriverCapabilities is the full set of capabilities nvidia-container-
+// runtime understands, used to reject typos/unknown values outright.
+var allDriverCapabilities = map[DriverCapability]struct{}{
+	DriverCapabilityCompute:  {},
+	DriverCapabilityUtility:  {},
+	DriverCapabilityGraphics: {},
+	DriverCapabilityVideo:    {},
+	DriverCapabilityDisplay:  {},
+	DriverCapabilityCompat32: {},
+}
+
+// DefaultAllowedDriverCapabilities is used when the agent has not been
+// configured with ECS_NVIDIA_ALLOWED_DRIVER_CAPABILITIES, preserving the
+// behavior tasks saw before per-container capabilities were configurable.
+var DefaultAllowedDriverCapabilities = []DriverCapability{
+	DriverCapabilityUtility,
+	DriverCapabilityCompute,
+}
+
+// LoadAllowedDriverCapabilities reads AllowedDriverCapabilitiesEnvVar
+// (ECS_NVIDIA_ALLOWED_DRIVER_CAPABILITIES) from the environment and parses
+// it as a comma-separated list of driver capabilities. It falls back to
+// DefaultAllowedDriverCapabilities when the variable is unset or contains
+// an unrecognized capability, so a misconfigured agent fails safe to the
+// historical default rather than silently allowing nothing.
+func LoadAllowedDriverCapabilities() []DriverCapability {
+	value := os.Getenv(AllowedDriverCapabilitiesEnvVar)
+	if value == "" {
+		return DefaultAllowedDriverCapabilities
+	}
+
+	capabilities := make([]DriverCapability, 0)
+	for _, raw := range strings.Split(value, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		capability := DriverCapability(raw)
+		if _, ok := allDriverCapabilities[capability]; !ok {
+			seelog.Warnf(
+				"gpu: %s contains unknown NVIDIA driver capability %q, falling back to the default allow-list",
+				AllowedDriverCapabilitiesEnvVar, raw)
+			return DefaultAllowedDriverCapabilities
+		}
+		capabilities = append(capabilities, capability)
+	}
+	if len(capabilities) == 0 {
+		return DefaultAllowedDriverCapabilities
+	}
+	return capabilities
+}
+
+// ValidateDriverCapabilities checks that every capability requested by a
+// task is both a recognized NVIDIA driver capability and present in the
+// agent's configured allow-list. It returns the validated, de-duplicated
+// capability set in allow-list order.
+func ValidateDriverCapabilities(requested []string, allowed []DriverCapability) ([]DriverCapability, error) {
+	allowedSet := make(map[DriverCapability]struct{}, len(allowed))
+	for _, capability := range allowed {
+		allowedSet[capability] = struct{}{}
+	}
+
+	requestedSet := make(map[DriverCapability]struct{}, len(requested))
+	for _, raw := range requested {
+		capability := DriverCapability(raw)
+		if _, ok := allDriverCapabilities[capability]; !ok {
+			return nil, errors.Errorf("unknown NVIDIA driver capability %q", raw)
+		}
+		if _, ok := allowedSet[capability]; !ok {
+			return nil, errors.Errorf(
+				"NVIDIA driver capability %q is not in the agent's allowed list", raw)
+		}
+		requestedSet[capability] = struct{}{}
+	}
+
+	// Preserve allow-list order so the resulting env var is deterministic.
+	validated := make([]DriverCapability, 0, len(requestedSet))
+	for _, capability := range allowed {
+		if _, ok := requestedSet[capability]; ok {
+			validated = append(validated, capability)
+		}
+	}
+	return validated, nil
+}
+
+// DriverCapabilitiesEnvValue renders capabilities as the comma-separated
+// value expected by NVIDIA_DRIVER_CAPABILITIES.
+func DriverCapabilitiesEnvValue(capabilities []DriverCapability) string {
+	values := make([]string, len(capabilities))
+	for i, capability := range capabilities {
+		values[i] = string(capability)
+	}
+	return strings.Join(values, ",")
+}
+
+// VisibleDevicesEnvValue renders GPU UUIDs as the comma-separated value
+// expected by NVIDIA_VISIBLE_DEVICES.
+func VisibleDevicesEnvValue(gpuIDs []string) string {
+	return strings.Join(gpuIDs, ",")
+}
@@ -0,0 +1,89 @@
+// +build linux
+
+// Copyright 2021 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package gpu
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestValidateDriverCapabilities(t *testing.T) {
+	allowed := []DriverCapability{DriverCapabilityUtility, DriverCapabilityCompute, DriverCapabilityVideo}
+
+	t.Run("subset of allowed, returned in allow-list order", func(t *testing.T) {
+		got, err := ValidateDriverCapabilities([]string{"compute", "utility"}, allowed)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		want := []DriverCapability{DriverCapabilityUtility, DriverCapabilityCompute}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("duplicate requests are de-duplicated", func(t *testing.T) {
+		got, err := ValidateDriverCapabilities([]string{"compute", "compute"}, allowed)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		want := []DriverCapability{DriverCapabilityCompute}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("unknown capability is rejected", func(t *testing.T) {
+		if _, err := ValidateDriverCapabilities([]string{"not-a-capability"}, allowed); err == nil {
+			t.Error("expected an error for an unknown capability, got nil")
+		}
+	})
+
+	t.Run("known capability outside the allow-list is rejected", func(t *testing.T) {
+		if _, err := ValidateDriverCapabilities([]string{"graphics"}, allowed); err == nil {
+			t.Error("expected an error for a disallowed capability, got nil")
+		}
+	})
+}
+
+func TestLoadAllowedDriverCapabilities(t *testing.T) {
+	defer os.Unsetenv(AllowedDriverCapabilitiesEnvVar)
+
+	t.Run("unset falls back to the default", func(t *testing.T) {
+		os.Unsetenv(AllowedDriverCapabilitiesEnvVar)
+		got := LoadAllowedDriverCapabilities()
+		if !reflect.DeepEqual(got, DefaultAllowedDriverCapabilities) {
+			t.Errorf("got %v, want %v", got, DefaultAllowedDriverCapabilities)
+		}
+	})
+
+	t.Run("parses a valid comma-separated list", func(t *testing.T) {
+		os.Setenv(AllowedDriverCapabilitiesEnvVar, "utility, graphics ,video")
+		got := LoadAllowedDriverCapabilities()
+		want := []DriverCapability{DriverCapabilityUtility, DriverCapabilityGraphics, DriverCapabilityVideo}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("unknown capability falls back to the default", func(t *testing.T) {
+		os.Setenv(AllowedDriverCapabilitiesEnvVar, "utility,bogus")
+		got := LoadAllowedDriverCapabilities()
+		if !reflect.DeepEqual(got, DefaultAllowedDriverCapabilities) {
+			t.Errorf("got %v, want %v", got, DefaultAllowedDriverCapabilities)
+		}
+	})
+}
@@ -0,0 +1,50 @@
+// +build linux
+
+// Copyright 2021 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package gpu
+
+import (
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// nvidiaPCIVendorID is the PCI vendor ID NVIDIA devices are registered
+// under, as reported by lspci.
+const nvidiaPCIVendorID = "10de"
+
+// isNvidiaGPUPresent shells out to lspci to determine whether an NVIDIA GPU
+// is present on the host. It is used as a fallback when NVML cannot be
+// loaded (missing library, driver mismatch) so the agent can still tell the
+// difference between "no NVIDIA GPU" and "NVML is broken".
+var isNvidiaGPUPresent = func() (bool, error) {
+	out, err := exec.Command("lspci", "-mm", "-nnk").CombinedOutput()
+	if err != nil {
+		return false, errors.Wrapf(err, "lspci: failed to list PCI devices")
+	}
+	return lspciOutputHasNvidiaDevice(string(out)), nil
+}
+
+// lspciOutputHasNvidiaDevice scans the machine-readable lspci output (-mm
+// -nnk) for a device whose vendor ID matches NVIDIA's.
+func lspciOutputHasNvidiaDevice(lspciOutput string) bool {
+	for _, line := range strings.Split(lspciOutput, "\n") {
+		if strings.Contains(strings.ToLower(line), "["+nvidiaPCIVendorID+"]") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+// +build linux
+
+// Copyright 2021 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package gpu
+
+import "testing"
+
+func TestLspciOutputHasNvidiaDevice(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   bool
+	}{
+		{
+			name:   "nvidia device present",
+			output: `00:1e.0 "3D controller [0302]" "NVIDIA Corporation [10de]" "GP100GL [Tesla P100 PCIE 16GB] [15f7]" -r01 "NVIDIA Corporation [10de]" "Device [1014]"`,
+			want:   true,
+		},
+		{
+			name:   "no nvidia device",
+			output: `00:1f.2 "SATA controller [0106]" "Intel Corporation [8086]" "Sunrise Point-H SATA controller [a282]" -r31 "Lenovo [17aa]" "Device [5048]"`,
+			want:   false,
+		},
+		{
+			name:   "vendor id substring collision doesn't false-positive",
+			output: `00:02.0 "VGA compatible controller [0300]" "Some Vendor [110de]" "Unrelated [0001]"`,
+			want:   false,
+		},
+		{
+			name:   "empty output",
+			output: "",
+			want:   false,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := lspciOutputHasNvidiaDevice(tc.output); got != tc.want {
+				t.Errorf("lspciOutputHasNvidiaDevice(%q) = %v, want %v", tc.output, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+// +build linux
+
+// Copyright 2021 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package gpu
+
+import (
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/pkg/errors"
+)
+
+// MIGDevice describes a single Multi-Instance GPU slice carved out of a
+// parent GPU, e.g. on A100/H100 instances.
+type MIGDevice struct {
+	ParentGPUUUID     string `json:"ParentGPUUUID"`
+	UUID              string `json:"UUID"`
+	GPUInstanceID     int    `json:"GPUInstanceID"`
+	ComputeInstanceID int    `json:"ComputeInstanceID"`
+	MemoryMiB         uint64 `json:"MemoryMiB"`
+}
+
+// discoverMIGDevices enumerates the MIG slices of a single parent GPU, if
+// MIG mode is enabled on it. A device with MIG mode disabled (the common
+// case outside of A100/H100) returns an empty slice and no error.
+func discoverMIGDevices(parentUUID string, device nvml.Device) ([]MIGDevice, error) {
+	currentMode, _, ret := device.GetMigMode()
+	if ret == nvml.ERROR_NOT_SUPPORTED {
+		return nil, nil
+	}
+	if ret != nvml.SUCCESS {
+		return nil, errors.Errorf("nvml: failed to get MIG mode for %s: %v", parentUUID, nvml.ErrorString(ret))
+	}
+	if currentMode != nvml.DEVICE_MIG_ENABLE {
+		return nil, nil
+	}
+
+	maxMigDevices, ret := device.GetMaxMigDeviceCount()
+	if ret != nvml.SUCCESS {
+		return nil, errors.Errorf("nvml: failed to get max MIG device count for %s: %v", parentUUID, nvml.ErrorString(ret))
+	}
+
+	migDevices := make([]MIGDevice, 0, maxMigDevices)
+	for i := 0; i < maxMigDevices; i++ {
+		migHandle, ret := device.GetMigDeviceHandleByIndex(i)
+		if ret == nvml.ERROR_NOT_FOUND {
+			// No MIG instance configured at this index; indices need not
+			// be contiguous.
+			continue
+		}
+		if ret != nvml.SUCCESS {
+			return nil, errors.Errorf("nvml: failed to get MIG device %d for %s: %v", i, parentUUID, nvml.ErrorString(ret))
+		}
+
+		migDevice, err := migHandleToMIGDevice(parentUUID, migHandle)
+		if err != nil {
+			return nil, errors.Wrapf(err, "nvml: failed to read MIG device %d for %s", i, parentUUID)
+		}
+		migDevices = append(migDevices, migDevice)
+	}
+	return migDevices, nil
+}
+
+func migHandleToMIGDevice(parentUUID string, migHandle nvml.Device) (MIGDevice, error) {
+	uuid, ret := migHandle.GetUUID()
+	if ret != nvml.SUCCESS {
+		return MIGDevice{}, errors.Errorf("nvml: failed to get MIG UUID: %v", nvml.ErrorString(ret))
+	}
+
+	gpuInstanceID, ret := migHandle.GetGpuInstanceId()
+	if ret != nvml.SUCCESS {
+		return MIGDevice{}, errors.Errorf("nvml: failed to get GPU instance ID: %v", nvml.ErrorString(ret))
+	}
+
+	computeInstanceID, ret := migHandle.GetComputeInstanceId()
+	if ret != nvml.SUCCESS {
+		return MIGDevice{}, errors.Errorf("nvml: failed to get compute instance ID: %v", nvml.ErrorString(ret))
+	}
+
+	memoryMiB := uint64(0)
+	if memInfo, ret := migHandle.GetMemoryInfo(); ret == nvml.SUCCESS {
+		memoryMiB = memInfo.Total / (1024 * 1024)
+	}
+
+	return MIGDevice{
+		ParentGPUUUID:     parentUUID,
+		UUID:              uuid,
+		GPUInstanceID:     gpuInstanceID,
+		ComputeInstanceID: computeInstanceID,
+		MemoryMiB:         memoryMiB,
+	}, nil
+}
@@ -0,0 +1,139 @@
+// +build linux
+
+// Copyright 2021 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package gpu
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+)
+
+// fakeMigHandle is a test double for a single MIG device handle. It embeds
+// the (nil) nvml.Device interface so it satisfies the full interface
+// without having to implement every method NVML exposes; only the methods
+// migHandleToMIGDevice actually calls are overridden below.
+type fakeMigHandle struct {
+	nvml.Device
+	uuid              string
+	uuidRet           nvml.Return
+	gpuInstanceID     int
+	computeInstanceID int
+	memoryMiB         uint64
+}
+
+func (f *fakeMigHandle) GetUUID() (string, nvml.Return) { return f.uuid, f.uuidRet }
+func (f *fakeMigHandle) GetGpuInstanceId() (int, nvml.Return) {
+	return f.gpuInstanceID, nvml.SUCCESS
+}
+func (f *fakeMigHandle) GetComputeInstanceId() (int, nvml.Return) {
+	return f.computeInstanceID, nvml.SUCCESS
+}
+func (f *fakeMigHandle) GetMemoryInfo() (nvml.Memory, nvml.Return) {
+	return nvml.Memory{Total: f.memoryMiB * 1024 * 1024}, nvml.SUCCESS
+}
+
+// fakeMigModeDevice is a test double for a parent GPU device, exercising
+// discoverMIGDevices without requiring an implementation of nvml.Device's
+// full method set.
+type fakeMigModeDevice struct {
+	nvml.Device
+	currentMode   int
+	migModeRet    nvml.Return
+	maxMigDevices int
+	migHandles    map[int]nvml.Device
+}
+
+func (f *fakeMigModeDevice) GetMigMode() (int, int, nvml.Return) {
+	return f.currentMode, f.currentMode, f.migModeRet
+}
+func (f *fakeMigModeDevice) GetMaxMigDeviceCount() (int, nvml.Return) {
+	return f.maxMigDevices, nvml.SUCCESS
+}
+func (f *fakeMigModeDevice) GetMigDeviceHandleByIndex(index int) (nvml.Device, nvml.Return) {
+	if handle, ok := f.migHandles[index]; ok {
+		return handle, nvml.SUCCESS
+	}
+	return nil, nvml.ERROR_NOT_FOUND
+}
+
+func TestDiscoverMIGDevicesNotSupported(t *testing.T) {
+	device := &fakeMigModeDevice{migModeRet: nvml.ERROR_NOT_SUPPORTED}
+	migDevices, err := discoverMIGDevices("GPU-parent", device)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if migDevices != nil {
+		t.Errorf("expected no MIG devices when MIG isn't supported, got %v", migDevices)
+	}
+}
+
+func TestDiscoverMIGDevicesDisabled(t *testing.T) {
+	device := &fakeMigModeDevice{currentMode: nvml.DEVICE_MIG_DISABLE, migModeRet: nvml.SUCCESS}
+	migDevices, err := discoverMIGDevices("GPU-parent", device)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if migDevices != nil {
+		t.Errorf("expected no MIG devices when MIG mode is disabled, got %v", migDevices)
+	}
+}
+
+func TestDiscoverMIGDevicesEnabledWithSparseIndices(t *testing.T) {
+	device := &fakeMigModeDevice{
+		currentMode:   nvml.DEVICE_MIG_ENABLE,
+		migModeRet:    nvml.SUCCESS,
+		maxMigDevices: 3,
+		migHandles: map[int]nvml.Device{
+			// Index 1 has no configured instance; indices need not be
+			// contiguous, so discoverMIGDevices must skip it rather than
+			// erroring out.
+			0: &fakeMigHandle{uuid: "MIG-aaa", uuidRet: nvml.SUCCESS, gpuInstanceID: 1, computeInstanceID: 1, memoryMiB: 10240},
+			2: &fakeMigHandle{uuid: "MIG-bbb", uuidRet: nvml.SUCCESS, gpuInstanceID: 2, computeInstanceID: 1, memoryMiB: 5120},
+		},
+	}
+
+	got, err := discoverMIGDevices("GPU-parent", device)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []MIGDevice{
+		{ParentGPUUUID: "GPU-parent", UUID: "MIG-aaa", GPUInstanceID: 1, ComputeInstanceID: 1, MemoryMiB: 10240},
+		{ParentGPUUUID: "GPU-parent", UUID: "MIG-bbb", GPUInstanceID: 2, ComputeInstanceID: 1, MemoryMiB: 5120},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMigHandleToMIGDevice(t *testing.T) {
+	handle := &fakeMigHandle{
+		uuid:              "MIG-ccc",
+		uuidRet:           nvml.SUCCESS,
+		gpuInstanceID:     3,
+		computeInstanceID: 0,
+		memoryMiB:         2048,
+	}
+
+	got, err := migHandleToMIGDevice("GPU-parent", handle)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := MIGDevice{ParentGPUUUID: "GPU-parent", UUID: "MIG-ccc", GPUInstanceID: 3, ComputeInstanceID: 0, MemoryMiB: 2048}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
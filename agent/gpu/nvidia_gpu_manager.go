@@ -21,6 +21,7 @@ import (
 	"os"
 	"sync"
 
+	"github.com/cihub/seelog"
 	"github.com/pkg/errors"
 )
 
@@ -33,15 +34,67 @@ type GPUManager interface {
 	GetDriverVersion() string
 	SetRuntimeVersion(string)
 	GetRuntimeVersion() string
+	GetGPUDevices() []GPUDevice
+	GetMIGDevices() []MIGDevice
+	// GetSchedulableDeviceIDs returns every device ID the task engine's GPU
+	// resource accounting may hand out to satisfy a task's requested GPU
+	// count, so that a task asking for N GPUs can be satisfied by whole
+	// GPUs, MIG slices, or a mix of both.
+	GetSchedulableDeviceIDs() []string
+	SetAllowedDriverCapabilities([]DriverCapability)
+	GetAllowedDriverCapabilities() []DriverCapability
+	// BuildDockerEnv validates requestedCapabilities against the allowed
+	// driver capabilities and returns the NVIDIA_DRIVER_CAPABILITIES and
+	// NVIDIA_VISIBLE_DEVICES environment entries to set on the container's
+	// docker.HostConfig. gpuIDs is the set of GPU UUIDs assigned to the task.
+	BuildDockerEnv(requestedCapabilities []string, gpuIDs []string) ([]string, error)
+	// CheckDriverCompatibility validates a task's minimum driver/CUDA
+	// version requirements against the driver installed on this instance
+	// and the GPUs it has been assigned. See DriverCompatibilityError.
+	CheckDriverCompatibility(minDriver, minCUDA string, gpuIDs []string) error
 }
 
+// GPUDevice describes a single NVIDIA GPU as reported by NVML. It is richer
+// than the bare UUIDs in GPUIDs and is only populated when NVML discovery
+// succeeds.
+type GPUDevice struct {
+	UUID              string `json:"UUID"`
+	ProductName       string `json:"ProductName"`
+	PCIBusID          string `json:"PCIBusID"`
+	MemoryMiB         uint64 `json:"MemoryMiB"`
+	ComputeCapability string `json:"ComputeCapability"`
+}
+
+// gpuInfoSchemaVersion is bumped whenever the on-disk shape of
+// nvidia-gpu-info.json gains new fields, so that consumers can tell a
+// payload written by an older ecs-init apart from a newer one. Fields are
+// only ever added, never removed or repurposed, so old payloads without a
+// SchemaVersion (implicitly 0) still unmarshal cleanly into the current
+// struct; they just come up with zero-valued new fields.
+const gpuInfoSchemaVersion = 2
+
 // NvidiaGPUManager is used as a wrapper for NVML APIs and implements GPUManager
 // interface
 type NvidiaGPUManager struct {
-	DriverVersion       string   `json:"DriverVersion"`
-	NvidiaDockerVersion string   `json:"NvidiaDockerVersion"`
-	GPUIDs              []string `json:"GPUIDs"`
-	lock                sync.RWMutex
+	SchemaVersion       int         `json:"SchemaVersion"`
+	DriverVersion       string      `json:"DriverVersion"`
+	CUDAVersion         string      `json:"CUDAVersion"`
+	NvidiaDockerVersion string      `json:"NvidiaDockerVersion"`
+	GPUIDs              []string    `json:"GPUIDs"`
+	GPUDevices          []GPUDevice `json:"GPUDevices"`
+	MIGDevices          []MIGDevice `json:"MIGDevices"`
+	// AllowedDriverCapabilities is the set of NVIDIA_DRIVER_CAPABILITIES
+	// values tasks on this instance may request, configured via
+	// ECS_NVIDIA_ALLOWED_DRIVER_CAPABILITIES and defaulting to
+	// DefaultAllowedDriverCapabilities. It is not persisted to the
+	// nvidia-gpu-info.json cache; it is agent config, not host state.
+	AllowedDriverCapabilities []DriverCapability `json:"-"`
+	// driverCompatMatrix is loaded once, at construction time, from
+	// /etc/ecs/gpu-compat.json (or builtinDriverCompatMatrix if that file
+	// is absent) rather than re-read on every CheckDriverCompatibility
+	// call, since it's effectively static host config.
+	driverCompatMatrix []driverCompatEntry `json:"-"`
+	lock               sync.RWMutex
 }
 
 const (
@@ -51,13 +104,46 @@ const (
 	NvidiaGPUInfoFilePath = GPUInfoDirPath + "/nvidia-gpu-info.json"
 )
 
-// NewNvidiaGPUManager is used to obtain NvidiaGPUManager handle
+// NewNvidiaGPUManager is used to obtain NvidiaGPUManager handle. The
+// allowed driver capability list is read from
+// ECS_NVIDIA_ALLOWED_DRIVER_CAPABILITIES; see LoadAllowedDriverCapabilities.
 func NewNvidiaGPUManager() GPUManager {
-	return &NvidiaGPUManager{}
+	return &NvidiaGPUManager{
+		AllowedDriverCapabilities: LoadAllowedDriverCapabilities(),
+		driverCompatMatrix:        loadDriverCompatMatrix(),
+	}
 }
 
-// Initialize sets the fields of Nvidia GPU Manager struct
+// Initialize sets the fields of Nvidia GPU Manager struct. It first tries to
+// talk to NVML directly so that the agent has live, detailed device info
+// without depending on ecs-init having run first. If NVML can't be loaded
+// (missing library, driver mismatch), it falls back to an lspci-based probe
+// to at least determine whether an NVIDIA GPU is present, and then to the
+// nvidia-gpu-info.json cache file written by ecs-init, exactly as before.
 func (n *NvidiaGPUManager) Initialize() error {
+	if nvmlInfo, err := discoverGPUsViaNVML(); err == nil {
+		n.SetDriverVersion(nvmlInfo.DriverVersion)
+		n.SetCUDAVersion(nvmlInfo.CUDAVersion)
+		n.SetGPUDevices(nvmlInfo.Devices)
+		n.SetMIGDevices(nvmlInfo.MIGDevices)
+		gpuIDs := make([]string, 0, len(nvmlInfo.Devices))
+		for _, device := range nvmlInfo.Devices {
+			gpuIDs = append(gpuIDs, device.UUID)
+		}
+		n.SetGPUIDs(gpuIDs)
+		// Best-effort refresh of the cache file so that a restart of the
+		// agent without live NVML access (e.g. a container without the
+		// driver library mounted) can still recover this information.
+		n.writeGPUInfoCache()
+		return nil
+	}
+
+	if present, err := isNvidiaGPUPresent(); err != nil {
+		seelog.Warnf("gpu: could not probe for NVIDIA GPU via lspci: %v", err)
+	} else if !present {
+		return nil
+	}
+
 	if GPUInfoFileExists() {
 		// GPU info file found
 		gpuJSON, err := GetGPUInfoJSON()
@@ -72,10 +158,68 @@ func (n *NvidiaGPUManager) Initialize() error {
 		n.SetDriverVersion(nvidiaGPUInfo.GetDriverVersion())
 		n.SetGPUIDs(nvidiaGPUInfo.GetGPUIDs())
 		n.SetRuntimeVersion(nvidiaGPUInfo.GetRuntimeVersion())
+		n.SetCUDAVersion(nvidiaGPUInfo.GetCUDAVersion())
+		n.SetGPUDevices(nvidiaGPUInfo.GetGPUDevices())
+		n.SetMIGDevices(nvidiaGPUInfo.GetMIGDevices())
 	}
 	return nil
 }
 
+// writeGPUInfoCache persists the current manager state to
+// NvidiaGPUInfoFilePath so that it can be used as a fallback the next time
+// Initialize is called without direct NVML access. Failures are logged but
+// not propagated, since the cache is purely a convenience.
+//
+// NVML discovery never learns NvidiaDockerVersion (there's no NVML call for
+// "what nvidia-docker/nvidia-container-runtime version is installed"); only
+// ecs-init's original payload carries it. So before overwriting the cache,
+// preserve whatever NvidiaDockerVersion is already on disk instead of
+// clobbering it with the empty string.
+func (n *NvidiaGPUManager) writeGPUInfoCache() {
+	// Bump the schema version and marshal under the same write lock used
+	// by every setter, so a concurrent SetGPUIDs/SetDriverVersion/etc.
+	// can't race with json.Marshal reading the struct's fields.
+	n.lock.Lock()
+	if n.NvidiaDockerVersion == "" {
+		if existing, err := readGPUInfoCache(); err == nil && existing.NvidiaDockerVersion != "" {
+			n.NvidiaDockerVersion = existing.NvidiaDockerVersion
+		}
+	}
+	n.SchemaVersion = gpuInfoSchemaVersion
+	gpuJSON, err := json.Marshal(n)
+	n.lock.Unlock()
+	if err != nil {
+		seelog.Warnf("gpu: could not marshal GPU info for caching: %v", err)
+		return
+	}
+	if err := os.MkdirAll(GPUInfoDirPath, 0755); err != nil {
+		seelog.Warnf("gpu: could not create %s: %v", GPUInfoDirPath, err)
+		return
+	}
+	if err := ioutil.WriteFile(NvidiaGPUInfoFilePath, gpuJSON, 0644); err != nil {
+		seelog.Warnf("gpu: could not write %s: %v", NvidiaGPUInfoFilePath, err)
+	}
+}
+
+// readGPUInfoCache reads and unmarshals the existing NvidiaGPUInfoFilePath
+// cache, if any, without mutating the receiver. It's used to carry forward
+// ecs-init-only fields (e.g. NvidiaDockerVersion) that NVML discovery can't
+// populate itself.
+func readGPUInfoCache() (NvidiaGPUManager, error) {
+	if !GPUInfoFileExists() {
+		return NvidiaGPUManager{}, errors.New("no existing GPU info cache")
+	}
+	gpuJSON, err := GetGPUInfoJSON()
+	if err != nil {
+		return NvidiaGPUManager{}, errors.Wrapf(err, "could not read GPU file content")
+	}
+	var existing NvidiaGPUManager
+	if err := json.Unmarshal(gpuJSON, &existing); err != nil {
+		return NvidiaGPUManager{}, errors.Wrapf(err, "could not unmarshal GPU file content")
+	}
+	return existing, nil
+}
+
 var GPUInfoFileExists = CheckForGPUInfoFile
 
 func CheckForGPUInfoFile() bool {
@@ -127,6 +271,107 @@ func (n *NvidiaGPUManager) GetDriverVersion() string {
 	return n.DriverVersion
 }
 
+// SetCUDAVersion is a setter for the CUDA driver version
+func (n *NvidiaGPUManager) SetCUDAVersion(version string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.CUDAVersion = version
+}
+
+// GetCUDAVersion is a getter for the CUDA driver version
+func (n *NvidiaGPUManager) GetCUDAVersion() string {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return n.CUDAVersion
+}
+
+// SetGPUDevices is a setter for the detailed per-device GPU info
+func (n *NvidiaGPUManager) SetGPUDevices(devices []GPUDevice) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.GPUDevices = devices
+}
+
+// GetGPUDevices is a getter for the detailed per-device GPU info. It is
+// only populated when GPUs were discovered via NVML; managers that loaded
+// their state from the legacy nvidia-gpu-info.json cache may return nil.
+func (n *NvidiaGPUManager) GetGPUDevices() []GPUDevice {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return n.GPUDevices
+}
+
+// SetAllowedDriverCapabilities is a setter for the agent-configured driver
+// capability allow-list.
+func (n *NvidiaGPUManager) SetAllowedDriverCapabilities(capabilities []DriverCapability) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.AllowedDriverCapabilities = capabilities
+}
+
+// GetAllowedDriverCapabilities is a getter for the agent-configured driver
+// capability allow-list.
+func (n *NvidiaGPUManager) GetAllowedDriverCapabilities() []DriverCapability {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return n.AllowedDriverCapabilities
+}
+
+// BuildDockerEnv validates requestedCapabilities against the allowed driver
+// capabilities and renders the NVIDIA_DRIVER_CAPABILITIES and
+// NVIDIA_VISIBLE_DEVICES entries for the container's docker.HostConfig.Env.
+// If requestedCapabilities is empty, the allowed default is used so existing
+// task definitions keep working unchanged.
+func (n *NvidiaGPUManager) BuildDockerEnv(requestedCapabilities []string, gpuIDs []string) ([]string, error) {
+	allowed := n.GetAllowedDriverCapabilities()
+	if len(requestedCapabilities) == 0 {
+		requestedCapabilities = make([]string, len(allowed))
+		for i, capability := range allowed {
+			requestedCapabilities[i] = string(capability)
+		}
+	}
+
+	validated, err := ValidateDriverCapabilities(requestedCapabilities, allowed)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not validate requested NVIDIA driver capabilities")
+	}
+
+	return []string{
+		NvidiaDriverCapabilitiesEnvVar + "=" + DriverCapabilitiesEnvValue(validated),
+		NvidiaVisibleDevicesEnvVar + "=" + VisibleDevicesEnvValue(gpuIDs),
+	}, nil
+}
+
+// SetMIGDevices is a setter for the discovered MIG device topology.
+func (n *NvidiaGPUManager) SetMIGDevices(migDevices []MIGDevice) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.MIGDevices = migDevices
+}
+
+// GetMIGDevices is a getter for the discovered MIG device topology. It is
+// empty on instances without MIG-capable GPUs, or when MIG mode is
+// disabled on every GPU.
+func (n *NvidiaGPUManager) GetMIGDevices() []MIGDevice {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return n.MIGDevices
+}
+
+// GetSchedulableDeviceIDs returns whole-GPU UUIDs followed by MIG slice
+// UUIDs; see the GPUManager interface doc.
+func (n *NvidiaGPUManager) GetSchedulableDeviceIDs() []string {
+	gpuIDs := n.GetGPUIDs()
+	migDevices := n.GetMIGDevices()
+
+	ids := make([]string, 0, len(gpuIDs)+len(migDevices))
+	ids = append(ids, gpuIDs...)
+	for _, migDevice := range migDevices {
+		ids = append(ids, migDevice.UUID)
+	}
+	return ids
+}
+
 // SetRuntimeVersion is a setter for nvidia docker version
 func (n *NvidiaGPUManager) SetRuntimeVersion(version string) {
 	n.lock.Lock()
@@ -0,0 +1,138 @@
+// +build linux
+
+// Copyright 2021 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package gpu
+
+import (
+	"fmt"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/pkg/errors"
+)
+
+// nvmlDiscoveredGPUInfo holds everything we can learn about the host's GPUs
+// by talking to NVML directly, without relying on the nvidia-gpu-info.json
+// cache file written by ecs-init.
+type nvmlDiscoveredGPUInfo struct {
+	DriverVersion string
+	CUDAVersion   string
+	Devices       []GPUDevice
+	MIGDevices    []MIGDevice
+}
+
+// discoverGPUsViaNVML initializes NVML, walks every visible device and
+// returns the driver/CUDA versions along with per-device info. It is the
+// primary discovery mechanism; callers should fall back to the lspci probe
+// and/or the cached JSON file when this returns an error.
+var discoverGPUsViaNVML = func() (*nvmlDiscoveredGPUInfo, error) {
+	if ret := nvml.Init(); ret != nvml.SUCCESS {
+		return nil, errors.Errorf("nvml: failed to initialize: %v", nvml.ErrorString(ret))
+	}
+	defer nvml.Shutdown()
+
+	driverVersion, ret := nvml.SystemGetDriverVersion()
+	if ret != nvml.SUCCESS {
+		return nil, errors.Errorf("nvml: failed to get driver version: %v", nvml.ErrorString(ret))
+	}
+
+	cudaVersion := ""
+	if cudaVersionInt, ret := nvml.SystemGetCudaDriverVersion(); ret == nvml.SUCCESS {
+		cudaVersion = fmt.Sprintf("%d.%d", cudaVersionInt/1000, (cudaVersionInt%1000)/10)
+	}
+
+	count, ret := nvml.DeviceGetCount()
+	if ret != nvml.SUCCESS {
+		return nil, errors.Errorf("nvml: failed to get device count: %v", nvml.ErrorString(ret))
+	}
+
+	devices := make([]GPUDevice, 0, count)
+	var migDevices []MIGDevice
+	for i := 0; i < count; i++ {
+		device, ret := nvml.DeviceGetHandleByIndex(i)
+		if ret != nvml.SUCCESS {
+			return nil, errors.Errorf("nvml: failed to get handle for device %d: %v", i, nvml.ErrorString(ret))
+		}
+		gpuDevice, err := deviceToGPUDevice(device)
+		if err != nil {
+			return nil, errors.Wrapf(err, "nvml: failed to read device %d", i)
+		}
+		devices = append(devices, gpuDevice)
+
+		deviceMIGs, err := discoverMIGDevices(gpuDevice.UUID, device)
+		if err != nil {
+			return nil, errors.Wrapf(err, "nvml: failed to enumerate MIG devices for %s", gpuDevice.UUID)
+		}
+		migDevices = append(migDevices, deviceMIGs...)
+	}
+
+	return &nvmlDiscoveredGPUInfo{
+		DriverVersion: driverVersion,
+		CUDAVersion:   cudaVersion,
+		Devices:       devices,
+		MIGDevices:    migDevices,
+	}, nil
+}
+
+// deviceToGPUDevice reads the fields we care about off of an NVML device
+// handle. MIG slices are read separately, by migHandleToMIGDevice.
+func deviceToGPUDevice(device nvml.Device) (GPUDevice, error) {
+	uuid, ret := device.GetUUID()
+	if ret != nvml.SUCCESS {
+		return GPUDevice{}, errors.Errorf("nvml: failed to get UUID: %v", nvml.ErrorString(ret))
+	}
+
+	productName := ""
+	if name, ret := device.GetName(); ret == nvml.SUCCESS {
+		productName = name
+	}
+
+	pciInfo, ret := device.GetPciInfo()
+	pciBusID := ""
+	if ret == nvml.SUCCESS {
+		pciBusID = pciInfoBusID(pciInfo)
+	}
+
+	memoryMiB := uint64(0)
+	if memInfo, ret := device.GetMemoryInfo(); ret == nvml.SUCCESS {
+		memoryMiB = memInfo.Total / (1024 * 1024)
+	}
+
+	computeCapability := ""
+	if major, minor, ret := device.GetCudaComputeCapability(); ret == nvml.SUCCESS {
+		computeCapability = fmt.Sprintf("%d.%d", major, minor)
+	}
+
+	return GPUDevice{
+		UUID:              uuid,
+		ProductName:       productName,
+		PCIBusID:          pciBusID,
+		MemoryMiB:         memoryMiB,
+		ComputeCapability: computeCapability,
+	}, nil
+}
+
+// pciInfoBusID renders an nvml.PciInfo's BusId byte array as a string,
+// trimming the trailing NUL bytes.
+func pciInfoBusID(pciInfo nvml.PciInfo) string {
+	n := 0
+	for n < len(pciInfo.BusId) && pciInfo.BusId[n] != 0 {
+		n++
+	}
+	b := make([]byte, n)
+	for i := 0; i < n; i++ {
+		b[i] = byte(pciInfo.BusId[i])
+	}
+	return string(b)
+}
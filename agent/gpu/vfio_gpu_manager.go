@@ -0,0 +1,273 @@
+// +build linux
+
+// Copyright 2021 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package gpu
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/cihub/seelog"
+	"github.com/pkg/errors"
+)
+
+// GPUManagerMode selects how GPUManager exposes GPUs to task containers.
+type GPUManagerMode string
+
+const (
+	// GPUManagerModeNvidiaRuntime exposes GPUs through the nvidia container
+	// runtime, as NvidiaGPUManager always has. This is the default.
+	GPUManagerModeNvidiaRuntime GPUManagerMode = "nvidia-runtime"
+	// GPUManagerModeVFIO binds GPUs to vfio-pci and exposes them to
+	// containers as raw /dev/vfio/<group> character devices, bypassing the
+	// nvidia container runtime entirely. This is what lets Kata or
+	// Firecracker-style workloads do their own in-guest driver passthrough.
+	GPUManagerModeVFIO GPUManagerMode = "vfio"
+
+	// GPUManagerModeEnvVar is the agent config environment variable
+	// operators use to select the GPUManagerMode.
+	GPUManagerModeEnvVar = "ECS_GPU_MANAGER_MODE"
+)
+
+// LoadGPUManagerMode reads GPUManagerModeEnvVar (ECS_GPU_MANAGER_MODE) from
+// the environment, defaulting to GPUManagerModeNvidiaRuntime when the
+// variable is unset or holds an unrecognized value.
+func LoadGPUManagerMode() GPUManagerMode {
+	if GPUManagerMode(os.Getenv(GPUManagerModeEnvVar)) == GPUManagerModeVFIO {
+		return GPUManagerModeVFIO
+	}
+	return GPUManagerModeNvidiaRuntime
+}
+
+// NewGPUManager returns the GPUManager implementation selected by mode. If
+// mode is empty, it's resolved from ECS_GPU_MANAGER_MODE via
+// LoadGPUManagerMode, defaulting to the nvidia container runtime path used
+// historically.
+func NewGPUManager(mode GPUManagerMode) GPUManager {
+	if mode == "" {
+		mode = LoadGPUManagerMode()
+	}
+	if mode == GPUManagerModeVFIO {
+		return NewVFIOGPUManager()
+	}
+	return NewNvidiaGPUManager()
+}
+
+// pciDevicesPath is where the kernel exposes each PCI device's sysfs
+// attributes, including its IOMMU group membership. It's a var, rather than
+// a const, so tests can point it at a fixture directory.
+var pciDevicesPath = "/sys/bus/pci/devices"
+
+// VFIODevice describes a GPU bound to vfio-pci and the character device the
+// task engine should inject into the container to grant it access.
+type VFIODevice struct {
+	PCIBusID   string `json:"PCIBusID"`
+	IOMMUGroup string `json:"IOMMUGroup"`
+	// VFIODevicePath is the /dev/vfio/<group> character device backing this
+	// GPU's IOMMU group. Note that every device sharing the group is
+	// exposed through the same path, so the whole group is granted together.
+	VFIODevicePath string `json:"VFIODevicePath"`
+}
+
+// VFIOGPUManager implements GPUManager by binding NVIDIA GPUs to vfio-pci
+// and exposing them as raw character devices, instead of going through the
+// nvidia container runtime. It is selected via ECS_GPU_MANAGER_MODE=vfio.
+type VFIOGPUManager struct {
+	GPUIDs  []string     `json:"GPUIDs"`
+	Devices []VFIODevice `json:"Devices"`
+	lock    sync.RWMutex
+}
+
+// NewVFIOGPUManager is used to obtain a VFIOGPUManager handle.
+func NewVFIOGPUManager() GPUManager {
+	return &VFIOGPUManager{}
+}
+
+// Initialize discovers NVIDIA GPUs on the host by scanning
+// /sys/bus/pci/devices, rebinds them to vfio-pci if they aren't already
+// bound to it, and records their IOMMU group membership.
+func (v *VFIOGPUManager) Initialize() error {
+	entries, err := ioutil.ReadDir(pciDevicesPath)
+	if err != nil {
+		return errors.Wrapf(err, "vfio: could not list %s", pciDevicesPath)
+	}
+
+	var gpuIDs []string
+	var devices []VFIODevice
+	for _, entry := range entries {
+		pciBusID := entry.Name()
+		if !isNvidiaPCIDevice(pciBusID) {
+			continue
+		}
+
+		iommuGroup, err := iommuGroupForDevice(pciBusID)
+		if err != nil {
+			seelog.Warnf("vfio: could not determine IOMMU group for %s: %v", pciBusID, err)
+			continue
+		}
+
+		if err := bindDeviceToVFIO(pciBusID); err != nil {
+			seelog.Warnf("vfio: could not bind %s to vfio-pci: %v", pciBusID, err)
+			continue
+		}
+
+		gpuIDs = append(gpuIDs, pciBusID)
+		devices = append(devices, VFIODevice{
+			PCIBusID:       pciBusID,
+			IOMMUGroup:     iommuGroup,
+			VFIODevicePath: fmt.Sprintf("/dev/vfio/%s", iommuGroup),
+		})
+	}
+
+	v.SetGPUIDs(gpuIDs)
+	v.SetDevices(devices)
+	return nil
+}
+
+// isNvidiaPCIDevice reads the vendor file the kernel exposes for a PCI
+// device and checks whether it matches NVIDIA's vendor ID.
+func isNvidiaPCIDevice(pciBusID string) bool {
+	vendor, err := ioutil.ReadFile(filepath.Join(pciDevicesPath, pciBusID, "vendor"))
+	if err != nil {
+		return false
+	}
+	return strings.Contains(strings.ToLower(string(vendor)), nvidiaPCIVendorID)
+}
+
+// iommuGroupForDevice resolves the iommu_group symlink the kernel creates
+// for every PCI device under an IOMMU-protected bus and returns its group
+// number.
+func iommuGroupForDevice(pciBusID string) (string, error) {
+	link, err := filepath.EvalSymlinks(filepath.Join(pciDevicesPath, pciBusID, "iommu_group"))
+	if err != nil {
+		return "", errors.Wrapf(err, "no iommu_group symlink for %s (is IOMMU enabled?)", pciBusID)
+	}
+	return filepath.Base(link), nil
+}
+
+// bindDeviceToVFIO unbinds a PCI device from its current driver (if any)
+// and binds it to vfio-pci, the prerequisite for exposing it as a
+// /dev/vfio/<group> character device.
+var bindDeviceToVFIO = func(pciBusID string) error {
+	driverLink := filepath.Join(pciDevicesPath, pciBusID, "driver")
+	if currentDriver, err := filepath.EvalSymlinks(driverLink); err == nil {
+		if filepath.Base(currentDriver) == "vfio-pci" {
+			return nil
+		}
+		if err := ioutil.WriteFile(filepath.Join(driverLink, "unbind"), []byte(pciBusID), 0200); err != nil {
+			return errors.Wrapf(err, "could not unbind %s from %s", pciBusID, filepath.Base(currentDriver))
+		}
+	}
+
+	overridePath := filepath.Join(pciDevicesPath, pciBusID, "driver_override")
+	if err := ioutil.WriteFile(overridePath, []byte("vfio-pci"), 0200); err != nil {
+		return errors.Wrapf(err, "could not set driver_override for %s", pciBusID)
+	}
+
+	bindPath := "/sys/bus/pci/drivers/vfio-pci/bind"
+	if err := ioutil.WriteFile(bindPath, []byte(pciBusID), 0200); err != nil {
+		return errors.Wrapf(err, "could not bind %s to vfio-pci", pciBusID)
+	}
+	return nil
+}
+
+// SetGPUIDs sets the GPUIDs (PCI bus IDs, for VFIO mode)
+func (v *VFIOGPUManager) SetGPUIDs(gpuIDs []string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.GPUIDs = gpuIDs
+}
+
+// GetGPUIDs returns the GPUIDs (PCI bus IDs, for VFIO mode)
+func (v *VFIOGPUManager) GetGPUIDs() []string {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	return v.GPUIDs
+}
+
+// SetDevices is a setter for the discovered VFIO device specs.
+func (v *VFIOGPUManager) SetDevices(devices []VFIODevice) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.Devices = devices
+}
+
+// GetVFIODevices returns the device specs the task engine should inject
+// into a container as /dev/vfio/<group> character devices.
+func (v *VFIOGPUManager) GetVFIODevices() []VFIODevice {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	return v.Devices
+}
+
+// SetDriverVersion is unused in VFIO mode: there is no in-agent NVIDIA
+// driver concept to track since passthrough guests manage their own driver.
+// It is implemented only to satisfy the GPUManager interface.
+func (v *VFIOGPUManager) SetDriverVersion(string) {}
+
+// GetDriverVersion always returns "" in VFIO mode; see SetDriverVersion.
+func (v *VFIOGPUManager) GetDriverVersion() string { return "" }
+
+// SetRuntimeVersion is unused in VFIO mode, which does not go through the
+// nvidia container runtime. It is implemented only to satisfy the
+// GPUManager interface.
+func (v *VFIOGPUManager) SetRuntimeVersion(string) {}
+
+// GetRuntimeVersion always returns "" in VFIO mode; see SetRuntimeVersion.
+func (v *VFIOGPUManager) GetRuntimeVersion() string { return "" }
+
+// GetGPUDevices always returns nil in VFIO mode: NVML-derived device detail
+// is a property of the nvidia-container-runtime path. Use GetVFIODevices.
+func (v *VFIOGPUManager) GetGPUDevices() []GPUDevice { return nil }
+
+// GetMIGDevices always returns nil in VFIO mode. MIG slicing is meaningless
+// once a whole GPU has been handed off to a passthrough guest.
+func (v *VFIOGPUManager) GetMIGDevices() []MIGDevice { return nil }
+
+// GetSchedulableDeviceIDs returns the PCI bus IDs of the GPUs bound to
+// vfio-pci. There's no MIG-style slicing in VFIO mode, so this is just the
+// GPU IDs: a task requesting N GPUs is satisfied by N whole devices.
+func (v *VFIOGPUManager) GetSchedulableDeviceIDs() []string {
+	return v.GetGPUIDs()
+}
+
+// SetAllowedDriverCapabilities is unused in VFIO mode, which has no
+// nvidia-container-runtime to configure capabilities for. It is implemented
+// only to satisfy the GPUManager interface.
+func (v *VFIOGPUManager) SetAllowedDriverCapabilities([]DriverCapability) {}
+
+// GetAllowedDriverCapabilities always returns nil in VFIO mode; see
+// SetAllowedDriverCapabilities.
+func (v *VFIOGPUManager) GetAllowedDriverCapabilities() []DriverCapability { return nil }
+
+// BuildDockerEnv is not supported in VFIO mode: there is no
+// NVIDIA_DRIVER_CAPABILITIES/NVIDIA_VISIBLE_DEVICES handshake to make, since
+// the container never talks to the nvidia container runtime. Callers in
+// VFIO mode should use GetVFIODevices to get the device specs to inject
+// instead.
+func (v *VFIOGPUManager) BuildDockerEnv(requestedCapabilities []string, gpuIDs []string) ([]string, error) {
+	return nil, errors.New("vfio: NVIDIA_DRIVER_CAPABILITIES is not applicable in VFIO passthrough mode")
+}
+
+// CheckDriverCompatibility is always a no-op in VFIO mode: the in-guest
+// driver running inside the passthrough workload is outside the agent's
+// visibility, so there is nothing on the host to validate.
+func (v *VFIOGPUManager) CheckDriverCompatibility(minDriver, minCUDA string, gpuIDs []string) error {
+	return nil
+}
@@ -0,0 +1,133 @@
+// +build linux
+
+// Copyright 2021 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package gpu
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// withFakePCIDevicesPath builds a fixture sysfs tree under a temp directory
+// and points pciDevicesPath at it for the duration of the test.
+func withFakePCIDevicesPath(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "gpu-vfio-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	original := pciDevicesPath
+	pciDevicesPath = dir
+	t.Cleanup(func() { pciDevicesPath = original })
+
+	return dir
+}
+
+// addFakePCIDevice creates a fixture PCI device directory with a vendor
+// file and, if iommuGroup is non-empty, an iommu_group symlink pointing at
+// a directory named after the group number.
+func addFakePCIDevice(t *testing.T, baseDir, pciBusID, vendor, iommuGroup string) {
+	t.Helper()
+	deviceDir := filepath.Join(baseDir, pciBusID)
+	if err := os.MkdirAll(deviceDir, 0755); err != nil {
+		t.Fatalf("could not create device dir: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(deviceDir, "vendor"), []byte(vendor+"\n"), 0644); err != nil {
+		t.Fatalf("could not write vendor file: %v", err)
+	}
+	if iommuGroup == "" {
+		return
+	}
+
+	groupDir := filepath.Join(baseDir, "iommu_groups", iommuGroup)
+	if err := os.MkdirAll(groupDir, 0755); err != nil {
+		t.Fatalf("could not create iommu group dir: %v", err)
+	}
+	if err := os.Symlink(groupDir, filepath.Join(deviceDir, "iommu_group")); err != nil {
+		t.Fatalf("could not symlink iommu_group: %v", err)
+	}
+}
+
+func TestIsNvidiaPCIDevice(t *testing.T) {
+	dir := withFakePCIDevicesPath(t)
+	addFakePCIDevice(t, dir, "0000:00:1e.0", "0x10de", "")
+	addFakePCIDevice(t, dir, "0000:00:1f.2", "0x8086", "")
+
+	if !isNvidiaPCIDevice("0000:00:1e.0") {
+		t.Error("expected the 0x10de-vendored device to be recognized as NVIDIA")
+	}
+	if isNvidiaPCIDevice("0000:00:1f.2") {
+		t.Error("expected the 0x8086-vendored device to not be recognized as NVIDIA")
+	}
+	if isNvidiaPCIDevice("0000:00:99.9") {
+		t.Error("expected a nonexistent device to not be recognized as NVIDIA")
+	}
+}
+
+func TestIommuGroupForDevice(t *testing.T) {
+	dir := withFakePCIDevicesPath(t)
+	addFakePCIDevice(t, dir, "0000:00:1e.0", "0x10de", "5")
+
+	group, err := iommuGroupForDevice("0000:00:1e.0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if group != "5" {
+		t.Errorf("got group %q, want %q", group, "5")
+	}
+}
+
+func TestIommuGroupForDeviceMissingSymlink(t *testing.T) {
+	dir := withFakePCIDevicesPath(t)
+	addFakePCIDevice(t, dir, "0000:00:1e.0", "0x10de", "")
+
+	if _, err := iommuGroupForDevice("0000:00:1e.0"); err == nil {
+		t.Error("expected an error when the iommu_group symlink is missing (IOMMU disabled)")
+	}
+}
+
+func TestVFIOGPUManagerInitialize(t *testing.T) {
+	dir := withFakePCIDevicesPath(t)
+	addFakePCIDevice(t, dir, "0000:00:1e.0", "0x10de", "5")
+	addFakePCIDevice(t, dir, "0000:00:1f.2", "0x8086", "")
+
+	originalBind := bindDeviceToVFIO
+	bindDeviceToVFIO = func(pciBusID string) error { return nil }
+	t.Cleanup(func() { bindDeviceToVFIO = originalBind })
+
+	manager := &VFIOGPUManager{}
+	if err := manager.Initialize(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	wantGPUIDs := []string{"0000:00:1e.0"}
+	if !reflect.DeepEqual(manager.GetGPUIDs(), wantGPUIDs) {
+		t.Errorf("got GPU IDs %v, want %v", manager.GetGPUIDs(), wantGPUIDs)
+	}
+
+	wantDevices := []VFIODevice{{PCIBusID: "0000:00:1e.0", IOMMUGroup: "5", VFIODevicePath: "/dev/vfio/5"}}
+	if !reflect.DeepEqual(manager.GetVFIODevices(), wantDevices) {
+		t.Errorf("got VFIO devices %v, want %v", manager.GetVFIODevices(), wantDevices)
+	}
+
+	if !reflect.DeepEqual(manager.GetSchedulableDeviceIDs(), wantGPUIDs) {
+		t.Errorf("got schedulable device IDs %v, want %v", manager.GetSchedulableDeviceIDs(), wantGPUIDs)
+	}
+}